@@ -8,8 +8,11 @@ import (
 	"bytes"
 	"compress/gzip"
 	"context"
+	"crypto/sha1"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"net/http"
 	"path/filepath"
 	"regexp"
 	"sort"
@@ -18,12 +21,16 @@ import (
 
 	"cloud.google.com/go/storage"
 	"github.com/cenkalti/backoff"
+	"google.golang.org/api/googleapi"
 	"google.golang.org/api/iterator"
 )
 
 const (
 	opTimeout  = time.Second * 30 // default timeout for all operations
 	dateLayout = "20060102"
+	appendKeys = "append-keys"    // metadata holding the keys of recent appends
+	creatorKey = "append-creator" // metadata holding the key that created the object
+	maxKeys    = 100              // number of recent append keys to keep
 )
 
 // Appender enables distributed writing to a single object on google storage.
@@ -41,6 +48,46 @@ type Appender struct {
 //
 // This can be handy when multiple processes are writing to the same file.
 func (a *Appender) Append(ctx context.Context, data []byte, url string) error {
+	_, err := a.append(ctx, data, url, "")
+	return err
+}
+
+// AppendCreated works like Append, but also reports whether the target object
+// was created by this call. The returned bool is only meaningful when the
+// error is nil, and a retried call reports false if the target object was
+// created by the failed attempt. Use AppendWithKeyCreated for a result that
+// is stable across retries.
+func (a *Appender) AppendCreated(ctx context.Context, data []byte, url string) (bool, error) {
+	return a.append(ctx, data, url, "")
+}
+
+// AppendWithKey works like Append, but derives the name of the temporary
+// object from 'key' instead of generating a random one, and records 'key'
+// on the target object when composing. A retried call with the same key
+// overwrites the same temporary object rather than leaving an orphan behind,
+// and if the previous attempt already composed it, the temporary object is
+// deleted instead of being composed a second time. The keys of the last 100
+// keyed appends are recorded, so a retry is detected as such as long as it
+// is made before 100 other keyed appends have been made to the target object.
+func (a *Appender) AppendWithKey(ctx context.Context, data []byte, url, key string) error {
+	_, err := a.AppendWithKeyCreated(ctx, data, url, key)
+	return err
+}
+
+// AppendWithKeyCreated works like AppendWithKey, but also reports whether the
+// target object was created by an append with 'key'. Since the creating key is
+// recorded on the target object, a retried call reports the same result as
+// the attempt that created it. The returned bool is only meaningful when the
+// error is nil.
+func (a *Appender) AppendWithKeyCreated(ctx context.Context, data []byte, url, key string) (bool, error) {
+	if key == "" {
+		return false, errors.New("empty idempotency key")
+	}
+
+	return a.append(ctx, data, url, key)
+}
+
+func (a *Appender) append(ctx context.Context, data []byte, url, key string) (bool, error) {
 	maxBackoff := a.MaxBackoff
 	if maxBackoff == 0 {
 		maxBackoff = time.Minute * 10
@@ -48,32 +95,39 @@ func (a *Appender) Append(ctx context.Context, data []byte, url string) error {
 
 	c, err := storage.NewClient(ctx)
 	if err != nil {
-		return err
+		return false, err
 	}
 
 	if data, err = compress(data, a.Gzip); err != nil {
-		return err
+		return false, err
 	}
 
-	tmpObj, obj, err := objects(c, url, a.Gzip)
+	tmpObj, obj, err := objects(c, url, key, a.Gzip)
+	if err != nil {
+		return false, err
+	}
 
 	if err := writeToObj(ctx, tmpObj, data); err != nil {
-		return err
+		return false, err
 	}
 
 	// Does the object yet exist?
-	if _, err := obj.Attrs(ctx); err != nil {
+	created := false
+	if attr, err := obj.Attrs(ctx); err != nil {
 		if err == storage.ErrObjectNotExist {
-			if err := obj.NewWriter(ctx).Close(); err != nil {
-				return err
+			if created, err = create(ctx, obj, key); err != nil {
+				return false, err
 			}
 		} else {
-			return err
+			return false, err
 		}
+	} else if key != "" {
+		// A previous attempt with the same key may have created it.
+		created = attr.Metadata[creatorKey] == key
 	}
 
 	if d, _ := ctx.Deadline(); d.Before(time.Now()) {
-		return errors.New("context has timed out")
+		return false, errors.New("context has timed out")
 	}
 
 	bckoff := backoff.NewExponentialBackOff()
@@ -82,19 +136,53 @@ func (a *Appender) Append(ctx context.Context, data []byte, url string) error {
 	defer cancelf()
 
 	op := func() error {
-		return compose(ctx, obj, tmpObj)
+		return compose(ctx, obj, tmpObj, key)
+	}
+
+	if err := backoff.Retry(op, backoff.NewExponentialBackOff()); err != nil {
+		return false, err
+	}
+
+	return created, nil
+}
+
+// create creates obj as an empty object, recording key as its creator, unless
+// it has been created by someone else in the meantime. It returns true if obj
+// was created.
+func create(ctx context.Context, obj *storage.ObjectHandle, key string) (bool, error) {
+	cond := storage.Conditions{DoesNotExist: true}
+	w := obj.If(cond).NewWriter(ctx)
+	if key != "" {
+		w.Metadata = map[string]string{creatorKey: key}
 	}
+	if err := w.Close(); err != nil {
+		if preconditionFailed(err) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return true, nil
+}
 
-	return backoff.Retry(op, backoff.NewExponentialBackOff())
+// preconditionFailed returns true if err is caused by a failed precondition,
+// such as a generation mismatch.
+func preconditionFailed(err error) bool {
+	var e *googleapi.Error
+	return errors.As(err, &e) && e.Code == http.StatusPreconditionFailed
 }
 
-func objects(c *storage.Client, url string, gzip bool) (*storage.ObjectHandle, *storage.ObjectHandle, error) {
+func objects(c *storage.Client, url, key string, gzip bool) (*storage.ObjectHandle, *storage.ObjectHandle, error) {
 	bkt, pf, name, err := BucketPrefixObject(url)
 	if err != nil {
 		return nil, nil, err
 	}
 	path := filepath.Join(pf, name)
 	tmpPath := fmt.Sprintf("%s.%d", path, time.Now().Nanosecond())
+	if key != "" {
+		sum := sha1.Sum([]byte(key))
+		tmpPath = fmt.Sprintf("%s.%s", path, hex.EncodeToString(sum[:]))
+	}
 
 	if gzip {
 		path = path + ".gz"
@@ -136,12 +224,21 @@ func writeToObj(ctx context.Context, obj *storage.ObjectHandle, data []byte) err
 	return nil
 }
 
-func compose(ctx context.Context, obj, pobj *storage.ObjectHandle) error {
+func compose(ctx context.Context, obj, pobj *storage.ObjectHandle, key string) error {
 	attr, err := obj.Attrs(ctx)
 	if err != nil {
 		return backoff.Permanent(err)
 	}
 
+	// Has a previous attempt with the same key already been composed?
+	keys := strings.Fields(attr.Metadata[appendKeys])
+	if key != "" && hasKey(keys, keyHash(key)) {
+		if err = pobj.Delete(ctx); err != nil && err != storage.ErrObjectNotExist {
+			return backoff.Permanent(err)
+		}
+		return nil
+	}
+
 	pattr, err := pobj.Attrs(ctx)
 	if err != nil {
 		return backoff.Permanent(err)
@@ -150,6 +247,17 @@ func compose(ctx context.Context, obj, pobj *storage.ObjectHandle) error {
 	cond := storage.Conditions{GenerationMatch: attr.Generation}
 	composer := obj.If(cond).ComposerFrom(pobj, obj)
 	composer.ContentEncoding = pattr.ContentEncoding
+	composer.Metadata = make(map[string]string, len(attr.Metadata)+1)
+	for k, v := range attr.Metadata {
+		composer.Metadata[k] = v
+	}
+	if key != "" {
+		keys = append(keys, keyHash(key))
+		if len(keys) > maxKeys {
+			keys = keys[len(keys)-maxKeys:]
+		}
+		composer.Metadata[appendKeys] = strings.Join(keys, " ")
+	}
 	if attr, err = composer.Run(ctx); err != nil {
 		return err
 	}
@@ -161,6 +269,22 @@ func compose(ctx context.Context, obj, pobj *storage.ObjectHandle) error {
 	return nil
 }
 
+// keyHash returns a short hash of key, suitable for storing in metadata.
+func keyHash(key string) string {
+	sum := sha1.Sum([]byte(key))
+	return hex.EncodeToString(sum[:8])
+}
+
+func hasKey(keys []string, key string) bool {
+	for _, k := range keys {
+		if k == key {
+			return true
+		}
+	}
+
+	return false
+}
+
 // ObjectReader returns a pointer to a storage.Reader for the object identified
 // by url (on the form `gs://path-to-object`).
 func ObjectReader(url string) (*storage.Reader, error) {
@@ -266,34 +390,156 @@ func filterObjects(bkt, prefix, pattern string, dt time.Time, cmp func(d1, d2 ti
 		return nil, err
 	}
 
-	q := &storage.Query{Prefix: prefix}
-	iter := c.Bucket(bkt).Objects(ctx, q)
 	var objs []string
-	for {
-		o, err := iter.Next()
-		if err == iterator.Done {
-			break
-		}
-		if err != nil {
-			return nil, err
-		}
-
+	err = listObjects(ctx, c, bkt, prefix, func(o *storage.ObjectAttrs) error {
 		m := matcher.FindStringSubmatch(o.Name)
 		if len(m) != 2 {
-			continue
+			return nil
 		}
 
 		d, err := time.Parse(dateLayout, m[1])
 		if err != nil {
-			return nil, err
+			return err
 		}
 
 		if cmp(d, dt) {
 			objs = append(objs, o.Name)
 		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 
 	sort.Strings(objs)
 
 	return objs, nil
 }
+
+// listObjects calls fn for every object in bkt with the given prefix,
+// stopping at the first error.
+func listObjects(ctx context.Context, c *storage.Client, bkt, prefix string, fn func(*storage.ObjectAttrs) error) error {
+	q := &storage.Query{Prefix: prefix}
+	iter := c.Bucket(bkt).Objects(ctx, q)
+	for {
+		o, err := iter.Next()
+		if err == iterator.Done {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := fn(o); err != nil {
+			return err
+		}
+	}
+}
+
+// storageClasses orders the storage classes from warmest to coldest. Objects
+// in unknown classes are considered as warm as STANDARD.
+var storageClasses = map[string]int{
+	"STANDARD":                     0,
+	"MULTI_REGIONAL":               0,
+	"REGIONAL":                     0,
+	"DURABLE_REDUCED_AVAILABILITY": 0,
+	"NEARLINE":                     1,
+	"COLDLINE":                     2,
+	"ARCHIVE":                      3,
+}
+
+// TierRule moves objects older than Age to StorageClass.
+type TierRule struct {
+	Age          time.Duration
+	StorageClass string
+}
+
+// TierByAge rewrites all objects in a bucket with a given prefix to the
+// storage class of the matching rule with the greatest Age. The age of an
+// object is computed from its custom time if set, or else from its last
+// update, and objects without a custom time get their last update recorded
+// as custom time when rewritten, so that their age is kept across rewrites.
+// Objects are only ever moved to colder storage classes; objects already in
+// the target storage class or a colder one are left untouched, as are objects
+// that change while being tiered. It returns the number of rewritten objects.
+func TierByAge(ctx context.Context, bkt, prefix string, rules []TierRule) (int, error) {
+	for _, r := range rules {
+		if _, ok := storageClasses[r.StorageClass]; !ok {
+			return 0, fmt.Errorf("unknown storage class %q", r.StorageClass)
+		}
+	}
+
+	c, err := storage.NewClient(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+	n := 0
+	err = listObjects(ctx, c, bkt, prefix, func(o *storage.ObjectAttrs) error {
+		t := o.Updated
+		if !o.CustomTime.IsZero() {
+			t = o.CustomTime
+		}
+
+		r, ok := tierRule(rules, now.Sub(t))
+		if !ok || storageClasses[r.StorageClass] <= storageClasses[o.StorageClass] {
+			return nil
+		}
+
+		obj := c.Bucket(bkt).Object(o.Name)
+		if err := rewrite(ctx, obj, obj, o, r.StorageClass); err != nil {
+			if preconditionFailed(err) {
+				return nil
+			}
+			return err
+		}
+		n++
+
+		return nil
+	})
+
+	return n, err
+}
+
+// tierRule returns the rule with the greatest Age that age exceeds.
+func tierRule(rules []TierRule, age time.Duration) (TierRule, bool) {
+	var (
+		rule TierRule
+		ok   bool
+	)
+	for _, r := range rules {
+		if age > r.Age && (!ok || r.Age > rule.Age) {
+			rule, ok = r, true
+		}
+	}
+
+	return rule, ok
+}
+
+// rewrite copies src, with attributes attr, to dst, server side, setting the
+// storage class of dst to class. If src has no custom time its last update is
+// used, since the rewrite resets it. The rewrite only takes place if dst is at
+// the generation and metageneration of attr.
+func rewrite(ctx context.Context, dst, src *storage.ObjectHandle, attr *storage.ObjectAttrs, class string) error {
+	cond := storage.Conditions{
+		GenerationMatch:     attr.Generation,
+		MetagenerationMatch: attr.Metageneration,
+	}
+	copier := dst.If(cond).CopierFrom(src)
+	copier.ContentType = attr.ContentType
+	copier.ContentEncoding = attr.ContentEncoding
+	copier.ContentLanguage = attr.ContentLanguage
+	copier.ContentDisposition = attr.ContentDisposition
+	copier.CacheControl = attr.CacheControl
+	copier.Metadata = attr.Metadata
+	copier.StorageClass = class
+	copier.CustomTime = attr.CustomTime
+	if copier.CustomTime.IsZero() {
+		copier.CustomTime = attr.Updated
+	}
+	_, err := copier.Run(ctx)
+
+	return err
+}
@@ -3,6 +3,7 @@ package gs
 import (
 	"context"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"testing"
@@ -33,18 +34,37 @@ func TestAppend(t *testing.T) {
 	ctx, cancelf := context.WithTimeout(context.Background(), opTimeout)
 	defer cancelf()
 
-	err := a.Append(ctx, []byte(text), url)
+	c, err := storage.NewClient(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	o := filepath.Join(prefix, name+".gz")
+	obj := c.Bucket(bkt).Object(o)
+	obj.Delete(ctx)
+	defer obj.Delete(ctx)
+
+	created, err := a.AppendCreated(ctx, []byte(text), url)
 	if err != nil {
 		t.Error(err)
 	}
+	if !created {
+		t.Error("expected object to be created")
+	}
 
-	c, err := storage.NewClient(ctx)
+	created, err = a.AppendCreated(ctx, []byte(text), url)
+	if err != nil {
+		t.Error(err)
+	}
+	if created {
+		t.Error("expected object to already exist")
+	}
+
+	err = a.Append(ctx, []byte(text), url)
 	if err != nil {
 		t.Error(err)
 	}
 
-	o := filepath.Join(prefix, name+".gz")
-	obj := c.Bucket(bkt).Object(o)
 	attr, err := obj.Attrs(ctx)
 	if err != nil {
 		t.Fatal(err)
@@ -60,9 +80,168 @@ func TestAppend(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+}
 
+func TestAppendWithKey(t *testing.T) {
+	name := "keyedfile.txt"
+	o := filepath.Join(prefix, name)
+	url := fmt.Sprintf("gs://%s/%s", bkt, o)
+
+	a := Appender{}
+
+	ctx, cancelf := context.WithTimeout(context.Background(), opTimeout)
+	defer cancelf()
+
+	c, err := storage.NewClient(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	obj := c.Bucket(bkt).Object(o)
 	obj.Delete(ctx)
+	defer obj.Delete(ctx)
+
+	if err := a.AppendWithKey(ctx, []byte(text), url, ""); err == nil {
+		t.Error("expected error for empty key")
+	}
+
+	// The last call simulates a retry of the first one, with an append
+	// by another writer in between.
+	for _, tst := range []struct {
+		key     string
+		created bool
+	}{
+		{"key", true},
+		{"other", false},
+		{"key", true},
+	} {
+		created, err := a.AppendWithKeyCreated(ctx, []byte(text), url, tst.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if created != tst.created {
+			t.Errorf("expected %v, got %v", tst.created, created)
+		}
+	}
+
+	r, err := obj.NewReader(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != text+text {
+		t.Errorf("expected %q, got %q", text+text, b)
+	}
+
+	iter := c.Bucket(bkt).Objects(ctx, &storage.Query{Prefix: o + "."})
+	if attr, err := iter.Next(); err == nil {
+		t.Error("unexpected temporary object found: ", attr.Name)
+	}
+}
+
+func TestTierByAge(t *testing.T) {
+	pf := filepath.Join(prefix, "tier")
+	o := filepath.Join(pf, "tierfile.txt")
+
+	ctx, cancelf := context.WithTimeout(context.Background(), opTimeout)
+	defer cancelf()
+
+	c, err := storage.NewClient(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := TierByAge(ctx, bkt, pf, []TierRule{{StorageClass: "coldline"}}); err == nil {
+		t.Error("expected error for unknown storage class")
+	}
+
+	obj := c.Bucket(bkt).Object(o)
+	w := obj.NewWriter(ctx)
+	w.ContentType = "text/plain"
+	w.Metadata = map[string]string{"foo": "bar"}
+	if _, err := w.Write([]byte(text)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	defer obj.Delete(ctx)
+
+	attr, err := obj.Attrs(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tst := range []struct {
+		class string
+		n     int
+	}{
+		{"NEARLINE", 1},
+		{"NEARLINE", 0},
+		{"STANDARD", 0},
+	} {
+		n, err := TierByAge(ctx, bkt, pf, []TierRule{{StorageClass: tst.class}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != tst.n {
+			t.Errorf("expected %d, got %d", tst.n, n)
+		}
 
+		a, err := obj.Attrs(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a.StorageClass != "NEARLINE" {
+			t.Errorf("expected NEARLINE, got %s", a.StorageClass)
+		}
+		if !a.CustomTime.Truncate(time.Second).Equal(attr.Updated.Truncate(time.Second)) {
+			t.Errorf("expected %v, got %v", attr.Updated, a.CustomTime)
+		}
+		if a.ContentType != "text/plain" {
+			t.Errorf("expected text/plain, got %s", a.ContentType)
+		}
+		if a.Metadata["foo"] != "bar" {
+			t.Errorf("expected bar, got %s", a.Metadata["foo"])
+		}
+	}
+}
+
+func TestObjectsWithKey(t *testing.T) {
+	ctx, cancelf := context.WithTimeout(context.Background(), opTimeout)
+	defer cancelf()
+
+	c, err := storage.NewClient(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	url := fmt.Sprintf("gs://%s/%s", bkt, filepath.Join(prefix, "myfile.txt"))
+
+	tmp1, _, err := objects(c, url, "key", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmp2, _, err := objects(c, url, "key", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tmp1.ObjectName() != tmp2.ObjectName() {
+		t.Errorf("expected %s, got %s", tmp1.ObjectName(), tmp2.ObjectName())
+	}
+
+	tmp3, _, err := objects(c, url, "other", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tmp1.ObjectName() == tmp3.ObjectName() {
+		t.Errorf("expected different temporary objects, got %s", tmp3.ObjectName())
+	}
 }
 
 func TestBucketPrefixObject(t *testing.T) {
@@ -89,6 +268,31 @@ func TestBucketPrefixObject(t *testing.T) {
 	}
 }
 
+func TestTierRule(t *testing.T) {
+	rules := []TierRule{
+		{Age: time.Hour * 24 * 365, StorageClass: "COLDLINE"},
+		{Age: time.Hour * 24 * 30, StorageClass: "NEARLINE"},
+	}
+
+	for _, tst := range []struct {
+		age   time.Duration
+		class string
+		ok    bool
+	}{
+		{time.Hour, "", false},
+		{time.Hour * 24 * 60, "NEARLINE", true},
+		{time.Hour * 24 * 400, "COLDLINE", true},
+	} {
+		r, ok := tierRule(rules, tst.age)
+		if ok != tst.ok {
+			t.Errorf("expected %v, got %v", tst.ok, ok)
+		}
+		if r.StorageClass != tst.class {
+			t.Errorf("expected %s, got %s", tst.class, r.StorageClass)
+		}
+	}
+}
+
 func TestObjectsBefore(t *testing.T) {
 	dt, _ := time.Parse("20060102", "20170103")
 	objs, err := ObjectsBefore(bkt, prefix, `testobj_(\d{8}).txt`, dt)